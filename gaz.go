@@ -16,35 +16,126 @@ limitations under the License.
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/repo"
 	"github.com/bazelbuild/bazel-gazelle/rule"
-	"github.com/btwiuse/pretty"
+	"github.com/bazelbuild/buildtools/build"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
+// LockFileImporter is implemented by language extensions that know how to
+// translate a third-party lock file (e.g. requirements_lock.txt,
+// package-lock.json) into repository rules. updateRepos dispatches
+// -from_file to the importer whose pattern matches the file name instead
+// of assuming a Go lock file.
+type LockFileImporter interface {
+	// LockFilePatterns returns the filename glob patterns (matched with
+	// filepath.Match against the base name) that this importer can read.
+	LockFilePatterns() []string
+
+	// ImportLockFile reads the lock file at path and returns the repos it
+	// declares, along with the rule kind and load info Gazelle should use
+	// to emit them.
+	ImportLockFile(path string) (repos []repo.Repo, kind string, loadInfo rule.LoadInfo, err error)
+}
+
+// findLockFileImporter returns the LockFileImporter among cexts whose
+// LockFilePatterns matches the base name of path, or nil if none matches.
+func findLockFileImporter(cexts []config.Configurer, path string) (LockFileImporter, error) {
+	base := filepath.Base(path)
+	var found LockFileImporter
+	for _, cext := range cexts {
+		importer, ok := cext.(LockFileImporter)
+		if !ok {
+			continue
+		}
+		matched := false
+		for _, pattern := range importer.LockFilePatterns() {
+			ok, err := filepath.Match(pattern, base)
+			if err != nil {
+				return nil, fmt.Errorf("invalid lock file pattern %q: %v", pattern, err)
+			}
+			if ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%s matches lock file patterns registered by more than one language", base)
+		}
+		found = importer
+	}
+	return found, nil
+}
+
 type goRepository struct {
-	Name       string
-	ImportPath string
-	Sum        string
-	Version    string
+	Name               string
+	ImportPath         string
+	Sum                string
+	Version            string
+	Replace            string
+	BuildDirectives    []string
+	BuildFileProtoMode string
+}
+
+// repoJSONFile is the schema used for -output=json and -input=json. It's
+// meant to be a stable interchange format: a dependabot-style bot or a
+// custom private-registry resolver can emit this instead of a go.mod/
+// Gopkg.lock and drive update-repos without Gazelle having to learn its
+// native format, and tooling downstream of Gazelle can consume the same
+// shape instead of scraping WORKSPACE. It's defined here in package main,
+// rather than in github.com/bazelbuild/bazel-gazelle/repo alongside
+// repo.Repo, because this repo only vendors that package's generated
+// API and can't add exported symbols to it; if this schema is promoted
+// to a real cross-tool contract it belongs there instead.
+type repoJSONFile struct {
+	Repos []repoJSON `json:"repos"`
+}
+
+type repoJSON struct {
+	Name               string   `json:"name"`
+	ImportPath         string   `json:"importpath"`
+	Version            string   `json:"version"`
+	Sum                string   `json:"sum,omitempty"`
+	Replace            string   `json:"replace,omitempty"`
+	BuildDirectives    []string `json:"build_directives,omitempty"`
+	BuildFileProtoMode string   `json:"build_file_proto_mode,omitempty"`
 }
 
 type updateReposConfig struct {
-	repoFilePath  string
-	importPaths   []string
-	macroFileName string
-	macroDefName  string
-	pruneRules    bool
-	workspace     *rule.File
-	repoFileMap   map[string]*rule.File
+	repoFilePath    string
+	importPaths     []string
+	macroFileName   string
+	macroDefName    string
+	moduleFileName  string
+	pruneRules      bool
+	verify          bool
+	sumdb           bool
+	workspaceModule bool
+	output          string
+	input           string
+	workspace       *rule.File
+	repoFileMap     map[string]*rule.File
+	moduleFile      *rule.File
+	moduleFileMap   map[string]*rule.File
 }
 
 const updateReposName = "_update-repos"
@@ -82,7 +173,13 @@ func (*updateReposConfigurer) RegisterFlags(fs *flag.FlagSet, cmd string, c *con
 	c.Exts[updateReposName] = uc
 	fs.StringVar(&uc.repoFilePath, "from_file", "", "Gazelle will translate repositories listed in this file into repository rules in WORKSPACE or a .bzl macro function. Gopkg.lock and go.mod files are supported")
 	fs.Var(macroFlag{macroFileName: &uc.macroFileName, macroDefName: &uc.macroDefName}, "to_macro", "Tells Gazelle to write repository rules into a .bzl macro function rather than the WORKSPACE file. . The expected format is: macroFile%defName")
+	fs.StringVar(&uc.moduleFileName, "to_module", "", "Tells Gazelle to write go_deps.module/use_repo directives into the MODULE.bazel file at this path rather than the WORKSPACE file or a .bzl macro. No bazel_dep directives are written. Mutually exclusive with -to_macro.")
 	fs.BoolVar(&uc.pruneRules, "prune", false, "When enabled, Gazelle will remove rules that no longer have equivalent repos in the Gopkg.lock/go.mod file. Can only used with -from_file.")
+	fs.BoolVar(&uc.verify, "verify", false, "When enabled, Gazelle checks the sum= attribute of every go_repository rule against go.sum (and, with -sumdb, against sum.golang.org) and fails without writing anything if any sum doesn't match.")
+	fs.BoolVar(&uc.sumdb, "sumdb", false, "When used with -verify, also checks sums against sum.golang.org. Can only be used with -verify.")
+	fs.BoolVar(&uc.workspaceModule, "workspace_module", false, "When used with a go.work -from_file, also emits each workspace module as a local_repository alongside the external go_repository deps. Can only be used with a go.work -from_file, and not with -to_module.")
+	fs.StringVar(&uc.output, "output", "starlark", "Controls how discovered repos are emitted: \"starlark\" (default) writes rules into WORKSPACE or the -to_module file; \"json\" instead prints the repoJSONFile schema to stdout and skips writing any Starlark file.")
+	fs.StringVar(&uc.input, "input", "", "When set to \"json\", -from_file is read as a repoJSONFile document (the same schema -output=json produces) instead of being parsed as go.mod/Gopkg.lock/go.work.")
 }
 
 func (*updateReposConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) error {
@@ -95,12 +192,48 @@ func (*updateReposConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) err
 
 	default:
 		if len(fs.Args()) == 0 {
-			return fmt.Errorf("no repositories specified\nTry -help for more information.")
-		}
-		if uc.pruneRules {
-			return fmt.Errorf("the -prune option can only be used with -from_file")
+			if goWorkPath := filepath.Join(c.RepoRoot, "go.work"); fileExists(goWorkPath) {
+				uc.repoFilePath = goWorkPath
+			} else {
+				return fmt.Errorf("no repositories specified\nTry -help for more information.")
+			}
+		} else {
+			if uc.pruneRules {
+				return fmt.Errorf("the -prune option can only be used with -from_file")
+			}
+			uc.importPaths = fs.Args()
 		}
-		uc.importPaths = fs.Args()
+	}
+
+	if uc.moduleFileName != "" && uc.macroFileName != "" {
+		return fmt.Errorf("-to_module and -to_macro are mutually exclusive")
+	}
+	if uc.sumdb && !uc.verify {
+		return fmt.Errorf("-sumdb can only be used with -verify")
+	}
+	if uc.workspaceModule && filepath.Base(uc.repoFilePath) != "go.work" {
+		return fmt.Errorf("-workspace_module can only be used with a go.work -from_file")
+	}
+	if uc.workspaceModule && uc.moduleFileName != "" {
+		// addWorkspaceModules, the only code that honors -workspace_module,
+		// only ever writes local_repository rules to WORKSPACE. With
+		// -to_module it's skipped entirely in favor of updateModuleFile, so
+		// -workspace_module would silently do nothing; reject the
+		// combination rather than accept a flag that has no effect.
+		return fmt.Errorf("-workspace_module is not supported with -to_module")
+	}
+	switch uc.output {
+	case "starlark", "json":
+	default:
+		return fmt.Errorf("invalid -output %q: must be \"starlark\" or \"json\"", uc.output)
+	}
+	switch uc.input {
+	case "", "json":
+	default:
+		return fmt.Errorf("invalid -input %q: must be \"json\"", uc.input)
+	}
+	if uc.input == "json" && uc.repoFilePath == "" {
+		return fmt.Errorf("-input=json requires -from_file")
 	}
 
 	var err error
@@ -114,9 +247,40 @@ func (*updateReposConfigurer) CheckFlags(fs *flag.FlagSet, c *config.Config) err
 		return fmt.Errorf("loading WORKSPACE file: %v", err)
 	}
 
+	if uc.moduleFileName != "" {
+		modulePath := filepath.Join(c.RepoRoot, uc.moduleFileName)
+		uc.moduleFile, err = loadModuleFile(modulePath, "")
+		if err != nil {
+			return fmt.Errorf("loading MODULE.bazel file: %v", err)
+		}
+		uc.moduleFileMap = map[string]*rule.File{uc.moduleFileName: uc.moduleFile}
+	}
+
 	return nil
 }
 
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// loadModuleFile loads the MODULE.bazel file at path, or returns a new
+// empty one if it doesn't exist yet. There is no rule.LoadWorkspaceFile
+// equivalent for MODULE.bazel upstream, so this mirrors what that function
+// does internally: read the file if present and hand the bytes to
+// rule.LoadData, which is the same lower-level parser LoadWorkspaceFile and
+// LoadMacroFile are built on.
+func loadModuleFile(path, pkg string) (*rule.File, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rule.EmptyFile(path, pkg), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rule.LoadData(path, pkg, data)
+}
+
 func (*updateReposConfigurer) KnownDirectives() []string { return nil }
 
 func (*updateReposConfigurer) Configure(c *config.Config, rel string, f *rule.File) {}
@@ -140,17 +304,85 @@ func updateRepos(args []string) (err error) {
 	if err != nil {
 		return err
 	}
-	// uc := getUpdateReposConfig(c)
+	uc := getUpdateReposConfig(c)
+
+	// -input=json reads the repoJSONFile schema directly, bypassing the
+	// go.work/go.mod/lock-file dispatch below entirely.
+	var workGoRepos []*goRepository
+	var workKnownRepos []repo.Repo
+	if uc.input == "json" {
+		jsonGoRepos, jsonKnownRepos, err := readJSONRepos(uc.repoFilePath)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", uc.repoFilePath, err)
+		}
+		return finishUpdateRepos(uc, c.RepoRoot, jsonGoRepos, jsonKnownRepos, nil)
+	}
+
+	// writeWorkspace, if set, performs whichever WORKSPACE mutation this run
+	// needs. It's deferred and run by finishUpdateRepos, after -verify has
+	// had a chance to fail and only when -output isn't "json", so neither
+	// contract is violated by writing WORKSPACE too early.
+	var writeWorkspace func() error
+
+	// If -from_file points at a go.work file, aggregate every module it
+	// "use"s into one deduplicated set of repos instead of reading a single
+	// go.mod.
+	if filepath.Base(uc.repoFilePath) == "go.work" {
+		var err error
+		workGoRepos, workKnownRepos, err = loadGoWorkRepos(uc.repoFilePath)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", uc.repoFilePath, err)
+		}
+		// uc.moduleFile is handled generically below via finishUpdateRepos/
+		// updateModuleFile (go_deps.module, not go_repository/local_repository),
+		// so only write WORKSPACE directly when there's no MODULE.bazel target.
+		if uc.moduleFile == nil {
+			workRoot := filepath.Dir(uc.repoFilePath)
+			writeWorkspace = func() error {
+				return addWorkspaceModules(uc, workRoot, workGoRepos)
+			}
+		}
+	}
+
+	// If -from_file points at a lock file that a language extension knows
+	// how to read, dispatch to it instead of assuming Go. Kind/loadInfo are
+	// threaded through so pruneRules can prune the right rule kind below.
+	var importedKind string
+	var importedLoadInfo rule.LoadInfo
+	var importedRepos []repo.Repo
+	if uc.repoFilePath != "" && workGoRepos == nil && filepath.Base(uc.repoFilePath) != "go.mod" && filepath.Base(uc.repoFilePath) != "Gopkg.lock" {
+		importer, err := findLockFileImporter(cexts, uc.repoFilePath)
+		if err != nil {
+			return err
+		}
+		if importer == nil {
+			return fmt.Errorf("%s: no language extension registered a lock file importer for this file", uc.repoFilePath)
+		}
+		importedRepos, importedKind, importedLoadInfo, err = importer.ImportLockFile(uc.repoFilePath)
+		if err != nil {
+			return fmt.Errorf("importing %s: %v", uc.repoFilePath, err)
+		}
+	}
 
 	// TODO(jayconrod): move Go-specific RemoteCache logic to language/go.
 	var knownRepos []repo.Repo
+	var goRepos []*goRepository
+	knownRepos = append(knownRepos, workKnownRepos...)
+	goRepos = append(goRepos, workGoRepos...)
 	for _, r := range c.Repos {
 		if r.Kind() == "go_repository" {
+			version, err := canonicalVersion(r.AttrString("version"))
+			if err != nil {
+				return fmt.Errorf("%s: %v", r.Name(), err)
+			}
 			gr := &goRepository{
-				Name:       r.AttrString("name"),
-				ImportPath: r.AttrString("importpath"),
-				Sum:        r.AttrString("sum"),
-				Version:    goVersion(r.AttrString("version")),
+				Name:               r.AttrString("name"),
+				ImportPath:         r.AttrString("importpath"),
+				Sum:                r.AttrString("sum"),
+				Version:            version,
+				Replace:            r.AttrString("replace"),
+				BuildDirectives:    r.AttrStrings("build_directives"),
+				BuildFileProtoMode: r.AttrString("build_file_proto_mode"),
 			}
 			kr := repo.Repo{
 				Name:     r.Name(),
@@ -159,18 +391,570 @@ func updateRepos(args []string) (err error) {
 				VCS:      r.AttrString("vcs"),
 			}
 			knownRepos = append(knownRepos, kr)
-			pretty.JSON(gr)
+			goRepos = append(goRepos, gr)
+		}
+	}
+	if importedKind != "" {
+		knownRepos = append(knownRepos, importedRepos...)
+		writeWorkspace = func() error {
+			if uc.pruneRules {
+				pruneRulesOfKind(c.Repos, importedKind, importedRepos)
+			}
+			emitImportedRepos(uc.workspace, importedKind, importedLoadInfo, importedRepos)
+			return uc.workspace.Save(uc.workspace.Path)
+		}
+	}
+
+	return finishUpdateRepos(uc, c.RepoRoot, goRepos, knownRepos, writeWorkspace)
+}
+
+// finishUpdateRepos runs the steps common to every -from_file/-input mode
+// once the set of repos has been discovered: deterministic ordering,
+// -verify, and then either -output=json (print the shared schema and skip
+// touching any Starlark file) or the WORKSPACE/-to_module write (no
+// -to_macro file is written). writeWorkspace, if non-nil, performs whatever WORKSPACE mutation
+// the caller deferred; it only runs after -verify has passed and never
+// when -output=json, so both "fails without writing anything" and "skip
+// WORKSPACE mutation" hold regardless of which -from_file mode is active.
+func finishUpdateRepos(uc *updateReposConfig, repoRoot string, goRepos []*goRepository, knownRepos []repo.Repo, writeWorkspace func() error) error {
+	// Sort by name so that regenerating WORKSPACE/MODULE.bazel from the
+	// same go.mod always produces byte-identical output.
+	sort.Slice(goRepos, func(i, j int) bool { return goRepos[i].Name < goRepos[j].Name })
+	sort.Slice(knownRepos, func(i, j int) bool { return knownRepos[i].Name < knownRepos[j].Name })
+
+	if uc.verify {
+		if err := verifyRepos(repoRoot, goRepos, uc.sumdb); err != nil {
+			return fmt.Errorf("verify failed: %v", err)
+		}
+	}
+
+	if uc.output == "json" {
+		return writeJSONRepos(os.Stdout, goRepos)
+	}
+
+	if writeWorkspace != nil {
+		if err := writeWorkspace(); err != nil {
+			return fmt.Errorf("writing WORKSPACE file: %v", err)
+		}
+	}
+
+	if uc.moduleFile != nil {
+		if err := updateModuleFile(uc, goRepos); err != nil {
+			return fmt.Errorf("updating MODULE.bazel file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// loadGoWorkRepos parses the go.work file at path and merges the require
+// graphs of every module it lists in a "use" directive into a single
+// deduplicated set of repos. replace directives declared in go.work take
+// precedence over the ones in each nested go.mod. Only the exclude
+// directives declared in go.work are applied; excludes in the nested go.mod
+// files are ignored.
+func loadGoWorkRepos(path string) ([]*goRepository, []repo.Repo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	wf, err := modfile.ParseWork(path, data, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	root := filepath.Dir(path)
+
+	// Only record module replacements (replace x => y vN), not filesystem
+	// path replacements (replace x => ../local), which have no version and
+	// are resolved as workspace modules via -workspace_module instead. A
+	// module replacement can retarget the import path as well as the
+	// version, so the full module.Version (not just the version string) is
+	// what has to flow through to the emitted repo.
+	workReplace := make(map[string]module.Version, len(wf.Replace))
+	for _, r := range wf.Replace {
+		if r.New.Version != "" {
+			workReplace[r.Old.Path] = r.New
+		}
+	}
+	workExclude := make(map[string]bool, len(wf.Exclude))
+	for _, e := range wf.Exclude {
+		workExclude[e.Mod.Path+"@"+e.Mod.Version] = true
+	}
+
+	// seen is keyed by the resolved (post-replace) import path. When two
+	// workspace modules require different versions of the same dependency,
+	// Go workspaces resolve this with MVS (minimal version selection: take
+	// the highest), never an error, so conflicts here pick the max version
+	// instead of failing the whole run.
+	seen := make(map[string]*goRepository)
+	var order []string
+	for _, use := range wf.Use {
+		modPath := filepath.Join(root, use.Path, "go.mod")
+		modData, err := os.ReadFile(modPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s: %v", modPath, err)
+		}
+		mf, err := modfile.Parse(modPath, modData, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing %s: %v", modPath, err)
+		}
+		modReplace := make(map[string]module.Version, len(mf.Replace))
+		for _, r := range mf.Replace {
+			if r.New.Version != "" {
+				modReplace[r.Old.Path] = r.New
+			}
+		}
+
+		for _, req := range mf.Require {
+			if workExclude[req.Mod.Path+"@"+req.Mod.Version] {
+				continue
+			}
+			resolved := req.Mod
+			if v, ok := workReplace[req.Mod.Path]; ok {
+				resolved = v
+			} else if v, ok := modReplace[req.Mod.Path]; ok {
+				resolved = v
+			}
+			cv, err := canonicalVersion(resolved.Version)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", resolved.Path, err)
+			}
+			if existing, ok := seen[resolved.Path]; ok {
+				if semver.Compare(cv, existing.Version) > 0 {
+					existing.Version = cv
+				}
+				continue
+			}
+			seen[resolved.Path] = &goRepository{
+				Name:       bazelRepoName(resolved.Path),
+				ImportPath: resolved.Path,
+				Version:    cv,
+			}
+			order = append(order, resolved.Path)
+		}
+	}
+
+	goRepos := make([]*goRepository, 0, len(order))
+	knownRepos := make([]repo.Repo, 0, len(order))
+	for _, importPath := range order {
+		gr := seen[importPath]
+		goRepos = append(goRepos, gr)
+		knownRepos = append(knownRepos, repo.Repo{Name: gr.Name, GoPrefix: gr.ImportPath})
+	}
+	return goRepos, knownRepos, nil
+}
+
+// addWorkspaceModules adds or updates a go_repository rule in WORKSPACE for
+// each repo in goRepos and, when -workspace_module is set, also emits a
+// local_repository rule for each module listed in a go.work "use" directive,
+// so that a monorepo can reference its own modules the same way it
+// references external deps.
+func addWorkspaceModules(uc *updateReposConfig, workRoot string, goRepos []*goRepository) error {
+	f := uc.workspace
+
+	// The external deps are the whole point of update-repos; write them
+	// first so a go.work run never produces a WORKSPACE with local repos
+	// and nothing for them to depend on.
+	existingGo := make(map[string]*rule.Rule)
+	for _, r := range f.Rules("go_repository") {
+		existingGo[r.Name()] = r
+	}
+	for _, gr := range goRepos {
+		r, ok := existingGo[gr.Name]
+		if !ok {
+			r = rule.NewRule("go_repository", gr.Name)
+			r.Insert(f)
+		}
+		r.SetAttr("importpath", gr.ImportPath)
+		r.SetAttr("version", gr.Version)
+		if gr.Sum != "" {
+			r.SetAttr("sum", gr.Sum)
 		}
 	}
 
+	if uc.workspaceModule {
+		data, err := os.ReadFile(filepath.Join(workRoot, "go.work"))
+		if err != nil {
+			return err
+		}
+		wf, err := modfile.ParseWork("go.work", data, nil)
+		if err != nil {
+			return err
+		}
+		existingLocal := make(map[string]bool)
+		for _, r := range f.Rules("local_repository") {
+			existingLocal[r.Name()] = true
+		}
+		for _, use := range wf.Use {
+			modPath := filepath.Join(workRoot, use.Path, "go.mod")
+			modData, err := os.ReadFile(modPath)
+			if err != nil {
+				return err
+			}
+			mf, err := modfile.Parse(modPath, modData, nil)
+			if err != nil {
+				return err
+			}
+			name := bazelRepoName(mf.Module.Mod.Path)
+			if existingLocal[name] {
+				continue
+			}
+			r := rule.NewRule("local_repository", name)
+			r.SetAttr("path", use.Path)
+			r.Insert(f)
+			existingLocal[name] = true
+		}
+	}
+
+	return f.Save(f.Path)
+}
+
+// bazelRepoName converts a Go import path into the repo name go_repository
+// conventionally uses, e.g. "github.com/pkg/errors" -> "com_github_pkg_errors".
+func bazelRepoName(importPath string) string {
+	parts := strings.Split(importPath, "/")
+	hostParts := strings.Split(parts[0], ".")
+	for i, j := 0, len(hostParts)-1; i < j; i, j = i+1, j-1 {
+		hostParts[i], hostParts[j] = hostParts[j], hostParts[i]
+	}
+	segments := append(hostParts, parts[1:]...)
+	name := strings.Join(segments, "_")
+	name = strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	return name
+}
+
+// pruneRulesOfKind deletes rules of the given kind from repos whose name is
+// not present in kept, so that -prune only removes rules of the kind the
+// current LockFileImporter emits and leaves rules of other kinds alone.
+func pruneRulesOfKind(repos []*rule.Rule, kind string, kept []repo.Repo) {
+	keptNames := make(map[string]bool, len(kept))
+	for _, kr := range kept {
+		keptNames[kr.Name] = true
+	}
+	for _, r := range repos {
+		if r.Kind() == kind && !keptNames[r.Name()] {
+			r.Delete()
+		}
+	}
+}
+
+// emitImportedRepos adds or updates a rule of the given kind for each repo
+// in repos, inserting the load statement loadInfo describes if it isn't
+// already present. This is what actually lands a LockFileImporter's output
+// in WORKSPACE; the importer's repos are not passed to -verify or to
+// -output=json.
+func emitImportedRepos(f *rule.File, kind string, loadInfo rule.LoadInfo, repos []repo.Repo) {
+	if len(repos) == 0 {
+		return
+	}
+	haveLoad := false
+	for _, l := range f.Loads {
+		if l.Name() == loadInfo.Name {
+			haveLoad = true
+			break
+		}
+	}
+	if !haveLoad {
+		load := rule.NewLoad(loadInfo.Name)
+		load.Add(loadInfo.Symbols...)
+		load.Insert(f, 0)
+	}
+	existing := make(map[string]*rule.Rule)
+	for _, r := range f.Rules(kind) {
+		existing[r.Name()] = r
+	}
+	for _, kr := range repos {
+		r, ok := existing[kr.Name]
+		if !ok {
+			r = rule.NewRule(kind, kr.Name)
+			r.Insert(f)
+		}
+		if kr.GoPrefix != "" {
+			r.SetAttr("importpath", kr.GoPrefix)
+		}
+		if kr.Remote != "" {
+			r.SetAttr("remote", kr.Remote)
+		}
+		if kr.VCS != "" {
+			r.SetAttr("vcs", kr.VCS)
+		}
+	}
+}
+
+// updateModuleFile adds or updates a go_deps.module(path=, version=, sum=)
+// declaration for each repo in goRepos, keeps the use_repo(go_deps, ...)
+// call in sync with the resulting set of repo names, and (when pruning is
+// enabled) removes go_deps.module rules and use_repo entries for repos that
+// are no longer present. Repos that already have a go_deps.module rule have
+// their path/version/sum refreshed in place; new repos get a new rule
+// appended.
+func updateModuleFile(uc *updateReposConfig, goRepos []*goRepository) error {
+	goDeps := uc.moduleFile.Rules("go_deps.module")
+	existing := make(map[string]*rule.Rule, len(goDeps))
+	for _, r := range goDeps {
+		existing[r.Name()] = r
+	}
+
+	for _, gr := range goRepos {
+		r, ok := existing[gr.Name]
+		if !ok {
+			r = rule.NewRule("go_deps.module", gr.Name)
+			r.Insert(uc.moduleFile)
+			existing[gr.Name] = r
+		}
+		r.SetAttr("path", gr.ImportPath)
+		r.SetAttr("version", gr.Version)
+		if gr.Sum != "" {
+			r.SetAttr("sum", gr.Sum)
+		}
+		if gr.Replace != "" {
+			r.SetAttr("replace", gr.Replace)
+		}
+		if len(gr.BuildDirectives) > 0 {
+			r.SetAttr("build_directives", gr.BuildDirectives)
+		}
+	}
+
+	if uc.pruneRules {
+		known := make(map[string]bool, len(goRepos))
+		for _, gr := range goRepos {
+			known[gr.Name] = true
+		}
+		for _, r := range goDeps {
+			if !known[r.Name()] {
+				r.Delete()
+			}
+		}
+	}
+
+	updateUseRepo(uc.moduleFile, goRepos, uc.pruneRules)
+
+	for _, f := range uc.moduleFileMap {
+		if err := f.Save(f.Path); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func goVersion(in string) (out string) {
-	parts := strings.Split(in, "-")
-	out = parts[len(parts)-1]
-	return
+// updateUseRepo keeps the single use_repo(go_deps, "name1", "name2", ...)
+// call in the module file in sync with goRepos. use_repo is a positional-arg
+// bzlmod tag, not a named-attr rule like go_repository, so it's manipulated
+// directly via the buildtools syntax tree rather than through rule.Rule.
+func updateUseRepo(f *rule.File, goRepos []*goRepository, prune bool) {
+	names := make([]string, 0, len(goRepos))
+	for _, gr := range goRepos {
+		names = append(names, gr.Name)
+	}
+	sort.Strings(names)
+
+	var call *build.CallExpr
+	for _, stmt := range f.File.Stmt {
+		if c, ok := stmt.(*build.CallExpr); ok {
+			if ident, ok := c.X.(*build.Ident); ok && ident.Name == "use_repo" {
+				call = c
+				break
+			}
+		}
+	}
+
+	if call == nil {
+		if len(names) == 0 {
+			return
+		}
+		call = &build.CallExpr{X: &build.Ident{Name: "use_repo"}}
+		call.List = append(call.List, &build.Ident{Name: "go_deps"})
+		f.File.Stmt = append(f.File.Stmt, call)
+	}
+
+	if prune {
+		args := make([]build.Expr, 0, len(names)+1)
+		if len(call.List) > 0 {
+			args = append(args, call.List[0])
+		}
+		for _, name := range names {
+			args = append(args, &build.StringExpr{Value: name})
+		}
+		call.List = args
+		return
+	}
+
+	present := make(map[string]bool, len(call.List))
+	if len(call.List) > 0 {
+		for _, a := range call.List[1:] {
+			if s, ok := a.(*build.StringExpr); ok {
+				present[s.Value] = true
+			}
+		}
+	}
+	for _, name := range names {
+		if !present[name] {
+			call.List = append(call.List, &build.StringExpr{Value: name})
+		}
+	}
 }
+
+// canonicalVersion validates the version attribute recorded on a
+// go_repository rule and returns it unchanged. Only pseudo-versions are
+// checked (their timestamp must parse); other versions pass through as is.
+// Unlike the old heuristic of splitting on "-" and
+// keeping the last field (which discarded the timestamp of pseudo-versions
+// and mishandled the "+incompatible" suffix), this defers to
+// golang.org/x/mod/module so pseudo-versions of the form
+// vX.Y.Z-yyyymmddhhmmss-abcdefabcdef round-trip intact.
+func canonicalVersion(in string) (string, error) {
+	if in == "" {
+		// A go_repository pinned by commit/tag/urls legitimately has no
+		// version attr; that's not an error, there's just nothing to
+		// canonicalize.
+		return "", nil
+	}
+	if module.IsPseudoVersion(in) {
+		if _, err := module.PseudoVersionTime(in); err != nil {
+			return "", fmt.Errorf("invalid pseudo-version %q: %v", in, err)
+		}
+	}
+	return in, nil
+}
+
+// verifyRepos checks the sum= attribute recorded for each go_repository
+// against go.sum (and, when sumdb is set, against sum.golang.org), mirroring
+// `go mod verify`. It fails on the first mismatch so that nothing is
+// written to WORKSPACE/MODULE.bazel from unverified data.
+func verifyRepos(repoRoot string, goRepos []*goRepository, sumdb bool) error {
+	sums, err := readGoSum(filepath.Join(repoRoot, "go.sum"))
+	if err != nil {
+		return fmt.Errorf("reading go.sum: %v", err)
+	}
+	for _, gr := range goRepos {
+		if gr.Sum == "" {
+			// Repos sourced from go.work don't carry a recorded sum=
+			// attribute the way go_repository rules in WORKSPACE do, so
+			// there's nothing to cross-check here.
+			continue
+		}
+		key := gr.ImportPath + "@" + gr.Version
+		want, ok := sums[key]
+		if !ok {
+			return fmt.Errorf("%s: no entry for %s in go.sum", gr.Name, key)
+		}
+		if gr.Sum != want {
+			return fmt.Errorf("%s: sum for %s does not match go.sum (have %s, want %s)", gr.Name, key, gr.Sum, want)
+		}
+		if sumdb {
+			dbSum, err := lookupSumDB(gr.ImportPath, gr.Version)
+			if err != nil {
+				return fmt.Errorf("%s: querying sum.golang.org: %v", gr.Name, err)
+			}
+			if dbSum != want {
+				return fmt.Errorf("%s: sum for %s does not match sum.golang.org", gr.Name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// readGoSum parses a go.sum file into a map from "importpath@version" to
+// the recorded h1: hash, skipping the /go.mod lines.
+func readGoSum(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		importPath, version, sum := fields[0], fields[1], fields[2]
+		if strings.HasSuffix(version, "/go.mod") {
+			continue
+		}
+		sums[importPath+"@"+version] = sum
+	}
+	return sums, nil
+}
+
+// lookupSumDB queries sum.golang.org for the recorded hash of a module at a
+// given version, for use in -sumdb verification.
+// lookupSumDB's response body is the record itself (one "module version
+// hash" line plus one "module version/go.mod hash" line), a blank line,
+// and then a signed note; we only want the h1: hash of the module line.
+func lookupSumDB(importPath, version string) (string, error) {
+	url := fmt.Sprintf("https://sum.golang.org/lookup/%s@%s", importPath, version)
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == importPath && fields[1] == version {
+			return fields[2], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no record for %s@%s in sumdb response", importPath, version)
+}
+
+// readJSONRepos reads a repoJSONFile document for -input=json, producing
+// the same (goRepos, knownRepos) shape the go.mod/go.work/lock-file paths
+// produce so that finishUpdateRepos can treat them identically.
+func readJSONRepos(path string) ([]*goRepository, []repo.Repo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rf repoJSONFile
+	if err := json.Unmarshal(data, &rf); err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	goRepos := make([]*goRepository, 0, len(rf.Repos))
+	knownRepos := make([]repo.Repo, 0, len(rf.Repos))
+	for _, rj := range rf.Repos {
+		goRepos = append(goRepos, &goRepository{
+			Name:               rj.Name,
+			ImportPath:         rj.ImportPath,
+			Sum:                rj.Sum,
+			Version:            rj.Version,
+			Replace:            rj.Replace,
+			BuildDirectives:    rj.BuildDirectives,
+			BuildFileProtoMode: rj.BuildFileProtoMode,
+		})
+		knownRepos = append(knownRepos, repo.Repo{
+			Name:     rj.Name,
+			GoPrefix: rj.ImportPath,
+		})
+	}
+	return goRepos, knownRepos, nil
+}
+
+// writeJSONRepos prints the repoJSONFile schema for -output=json.
+func writeJSONRepos(w io.Writer, goRepos []*goRepository) error {
+	rf := repoJSONFile{Repos: make([]repoJSON, 0, len(goRepos))}
+	for _, gr := range goRepos {
+		rf.Repos = append(rf.Repos, repoJSON{
+			Name:               gr.Name,
+			ImportPath:         gr.ImportPath,
+			Version:            gr.Version,
+			Sum:                gr.Sum,
+			Replace:            gr.Replace,
+			BuildDirectives:    gr.BuildDirectives,
+			BuildFileProtoMode: gr.BuildFileProtoMode,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rf)
+}
+
 func newUpdateReposConfiguration(args []string, cexts []config.Configurer) (*config.Config, error) {
 	c := config.New()
 	fs := flag.NewFlagSet("gazelle", flag.ContinueOnError)